@@ -19,22 +19,69 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"time"
 
+	"github.com/gogo/protobuf/proto"
 	"github.com/pkg/errors"
 
 	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing"
 )
 
 //go:generate go run -tags gen-batch gen_batch.go
 
+// StalenessBound describes the staleness tolerance of a non-transactional,
+// read-only BatchRequest that wants to be served as a bounded-staleness
+// (follower) read rather than requiring the current leaseholder, in the
+// same spirit as the INCONSISTENT read consistency level used today only
+// for internal RangeLookup traffic.
+type StalenessBound struct {
+	// MaxStalenessNanos bounds how far behind the present the resolved
+	// timestamp may be.
+	MaxStalenessNanos int64
+	// MinTimestampBound, if non-zero, is the earliest timestamp the
+	// resolved timestamp is allowed to take, regardless of
+	// MaxStalenessNanos.
+	MinTimestampBound hlc.Timestamp
+}
+
+// IsSet returns true iff the bound actually restricts the batch to a
+// bounded-staleness read.
+func (sb StalenessBound) IsSet() bool {
+	return sb.MaxStalenessNanos != 0 || sb.MinTimestampBound != (hlc.Timestamp{})
+}
+
+// NoStalenessConflict returns an error if ba carries a StalenessBound but
+// also contains an admin or write request. Bounded-staleness batches may
+// only ever be served against a single, read-only snapshot. This mirrors
+// the check SetActiveTimestamp already performs before assigning a stale
+// timestamp; callers that skip SetActiveTimestamp (or that want to fail
+// fast before doing so) can call this directly instead.
+func (ba *BatchRequest) NoStalenessConflict() error {
+	if ba.StalenessBound.IsSet() && ba.hasFlag(isWrite|isAdmin) {
+		return errors.New("bounded-staleness batch must not contain writes or admin requests")
+	}
+	return nil
+}
+
 // SetActiveTimestamp sets the correct timestamp at which the request
 // is to be carried out. For transactional requests, ba.Timestamp must
 // be zero initially and it will be set to txn.OrigTimestamp (and
 // forwarded to txn.SafeTimestamp if non-zero). For non-transactional
 // requests, if no timestamp is specified, nowFn is used to create and
-// set one.
-func (ba *BatchRequest) SetActiveTimestamp(nowFn func() hlc.Timestamp) error {
+// set one, unless the batch carries a StalenessBound: in that case, the
+// batch must be read-only and must not contain an EndTransaction, and
+// staleFn is consulted instead of nowFn to pick a timestamp within the
+// permitted staleness window.
+func (ba *BatchRequest) SetActiveTimestamp(
+	nowFn func() hlc.Timestamp,
+	staleFn func(minBound hlc.Timestamp, maxStaleness time.Duration) hlc.Timestamp,
+) error {
 	if txn := ba.Txn; txn != nil {
+		if ba.StalenessBound.IsSet() {
+			return errors.New("transactional request must not set a staleness bound")
+		}
 		if ba.Timestamp != (hlc.Timestamp{}) {
 			return errors.New("transactional request must not set batch timestamp")
 		}
@@ -48,6 +95,22 @@ func (ba *BatchRequest) SetActiveTimestamp(nowFn func() hlc.Timestamp) error {
 		// future timestamp at which the transaction would like to commit
 		// to safely avoid a serializable transaction restart.
 		ba.Timestamp.Forward(txn.RefreshedTimestamp)
+	} else if ba.StalenessBound.IsSet() {
+		// EndTransaction is itself a write, so it is checked first to give
+		// it its own error.
+		if _, ok := ba.GetArg(EndTransaction); ok {
+			return errors.New("bounded-staleness request must not contain an EndTransaction")
+		}
+		if ba.hasFlag(isWrite | isAdmin) {
+			return errors.New("bounded-staleness request must not contain writes")
+		}
+		if ba.Timestamp != (hlc.Timestamp{}) {
+			return errors.New("bounded-staleness request must not set batch timestamp")
+		}
+		ba.Timestamp = staleFn(
+			ba.StalenessBound.MinTimestampBound,
+			time.Duration(ba.StalenessBound.MaxStalenessNanos),
+		)
 	} else {
 		// When not transactional, allow empty timestamp and use nowFn instead
 		if ba.Timestamp == (hlc.Timestamp{}) {
@@ -218,9 +281,108 @@ func (ba *BatchRequest) GetArg(method Method) (Request, bool) {
 	return nil, false
 }
 
+// BatchSummary is a structured, machine-readable summary of the contents of
+// a BatchRequest or BatchResponse. It exists so that tracing, metrics, and
+// slow-query logging can pull this information directly instead of each
+// re-walking ba.Requests/br.Responses on their own.
+type BatchSummary struct {
+	// Txn is the transaction metadata carried by the batch, if any.
+	Txn *TxnMeta
+	// Methods counts how many requests of each Method are present. It is
+	// left empty by BatchResponse.Summary, which does not count responses.
+	Methods map[Method]int
+	// KeySpan runs from the smallest Key to the largest end among the key
+	// spans of every request (or, for a BatchResponse, every ResumeSpan) in
+	// the batch, where a point span's end is its Key. When that largest end
+	// comes from a point span, EndKey is a key the batch touches rather
+	// than an exclusive bound.
+	KeySpan Span
+	// TotalBytes is the estimated encoded size of the batch, in bytes.
+	TotalBytes int64
+	// HasEndTxn is true iff the batch contains an EndTransaction
+	// request/response.
+	HasEndTxn bool
+	// Commit is the commit flag of the EndTransaction request, if any. It
+	// is not populated from a BatchResponse, since EndTransactionResponse
+	// does not carry it.
+	Commit bool
+}
+
+// extendKeySpan grows *span, in place, so that span.Key is the smaller of the
+// two start keys and span.EndKey the larger of the two ends, taking a point
+// span's Key as its end. An empty other is ignored. It uses plain byte
+// comparisons rather than pkg/keys, so that BatchRequest/BatchResponse
+// don't need to import it just to compute a summary key range.
+func extendKeySpan(span *Span, other Span) {
+	if len(other.Key) == 0 {
+		return
+	}
+	if len(span.Key) == 0 || bytes.Compare(other.Key, span.Key) < 0 {
+		span.Key = other.Key
+	}
+	end := other.EndKey
+	if len(end) == 0 {
+		end = other.Key
+	}
+	if bytes.Compare(end, span.EndKey) > 0 {
+		span.EndKey = end
+	}
+}
+
+// Summary returns a structured summary of ba, suitable for use by tracing,
+// metrics, and slow-query logging. See BatchSummary.
+func (ba *BatchRequest) Summary() BatchSummary {
+	s := BatchSummary{Methods: make(map[Method]int, len(ba.Requests))}
+	if ba.Txn != nil {
+		s.Txn = &ba.Txn.TxnMeta
+	}
+	for i, union := range ba.Requests {
+		req := union.GetInner()
+		s.Methods[req.Method()]++
+		s.TotalBytes += int64(proto.Size(&ba.Requests[i]))
+		extendKeySpan(&s.KeySpan, req.Header().Span())
+		if et, ok := req.(*EndTransactionRequest); ok {
+			s.HasEndTxn = true
+			s.Commit = et.Commit
+		}
+	}
+	return s
+}
+
+// Summary returns a structured summary of br, suitable for use by tracing,
+// metrics, and slow-query logging. See BatchSummary.
+func (br *BatchResponse) Summary() BatchSummary {
+	s := BatchSummary{Methods: make(map[Method]int, len(br.Responses))}
+	if br.Txn != nil {
+		s.Txn = &br.Txn.TxnMeta
+	}
+	for i, union := range br.Responses {
+		resp := union.GetInner()
+		s.TotalBytes += int64(proto.Size(&br.Responses[i]))
+		if resumeSpan := resp.Header().ResumeSpan; resumeSpan != nil {
+			extendKeySpan(&s.KeySpan, *resumeSpan)
+		}
+		if _, ok := resp.(*EndTransactionResponse); ok {
+			s.HasEndTxn = true
+		}
+	}
+	return s
+}
+
+// String gives a brief summary of the contained responses and key range in
+// the batch. The txn and key range are taken from Summary(), so they stay in
+// sync with the structured view tracing/metrics consumers use; the response
+// types are listed by walking br.Responses.
 func (br *BatchResponse) String() string {
+	s := br.Summary()
 	var str []string
 	str = append(str, fmt.Sprintf("(err: %v)", br.Error))
+	if s.Txn != nil {
+		str = append(str, fmt.Sprintf("[txn: %s]", s.Txn.Short()))
+	}
+	if len(s.KeySpan.Key) > 0 {
+		str = append(str, fmt.Sprintf("[range: %s,%s)", s.KeySpan.Key, s.KeySpan.EndKey))
+	}
 	for _, union := range br.Responses {
 		str = append(str, fmt.Sprintf("%T", union.GetInner()))
 	}
@@ -273,6 +435,92 @@ func (ba *BatchRequest) RefreshSpanIterate(br *BatchResponse, fn func(Span, bool
 	}
 }
 
+// traceOpName returns the name TraceBatch uses for ba's batch-level span,
+// reflecting its classification as admin, read-only, or read-write.
+func (ba *BatchRequest) traceOpName() string {
+	switch {
+	case ba.IsAdmin():
+		return "admin batch"
+	case ba.IsReadOnly():
+		return "read-only batch"
+	case ba.IsWrite():
+		return "read-write batch"
+	}
+	return "batch"
+}
+
+// TraceBatch opens a child span on ctx named for the batch's classification
+// (admin, read-only, or read-write), and returns the context carrying it
+// along with two functions: startReq, which the caller must invoke
+// immediately before executing ba.Requests[i], and finishBatch, which
+// finishes the batch span and must be called once the whole batch is done.
+// startReq(i) opens and returns a further child span (as a context) for
+// request i, named for its method, plus a finishReq function that the
+// caller must invoke immediately after request i's real execution
+// completes, passing its response so the span can be tagged with the
+// actual key range touched (accounting for any ResumeSpan) before it's
+// finished. Because the per-request spans are opened and closed around the
+// caller's own execution of each request, their recorded duration reflects
+// genuine per-request latency -- unlike tagging an already-completed
+// BatchResponse after the fact, which can only produce zero-duration
+// markers. This makes it possible to attribute latency to individual
+// sub-requests of large batches, which today only show up as `%T` in
+// BatchResponse.String().
+func (ba *BatchRequest) TraceBatch(
+	ctx context.Context,
+) (batchCtx context.Context, startReq func(i int) (reqCtx context.Context, finishReq func(resp Response)), finishBatch func()) {
+	batchCtx, sp := tracing.ChildSpan(ctx, ba.traceOpName())
+
+	startReq = func(i int) (context.Context, func(resp Response)) {
+		req := ba.Requests[i].GetInner()
+		reqCtx, reqSp := tracing.ChildSpan(batchCtx, req.Method().String())
+		return reqCtx, func(resp Response) {
+			// ChildSpan returns no span when ctx carries none.
+			if reqSp == nil {
+				return
+			}
+			span := req.Header().Span()
+			if actual, ok := actualSpan(req, resp); ok {
+				span = actual
+			}
+			reqSp.SetTag("key", span.Key.String())
+			if len(span.EndKey) > 0 {
+				reqSp.SetTag("endKey", span.EndKey.String())
+			}
+			reqSp.Finish()
+		}
+	}
+
+	finishBatch = func() {
+		if sp != nil {
+			sp.Finish()
+		}
+	}
+	return batchCtx, startReq, finishBatch
+}
+
+// IntentSpanIterateWithTrace behaves like IntentSpanIterate, but additionally
+// logs each iterated span as a trace event on ctx, so that intent resolution
+// work can be correlated back to the batch that produced it.
+func (ba *BatchRequest) IntentSpanIterateWithTrace(ctx context.Context, br *BatchResponse, fn func(Span)) {
+	ba.IntentSpanIterate(br, func(span Span) {
+		log.Eventf(ctx, "intent span %s", span)
+		fn(span)
+	})
+}
+
+// RefreshSpanIterateWithTrace behaves like RefreshSpanIterate, but
+// additionally logs each iterated span as a trace event on ctx, so that
+// refresh work can be correlated back to the batch that produced it.
+func (ba *BatchRequest) RefreshSpanIterateWithTrace(
+	ctx context.Context, br *BatchResponse, fn func(Span, bool),
+) {
+	ba.RefreshSpanIterate(br, func(span Span, updatesTSCache bool) {
+		log.Eventf(ctx, "refresh span %s (updatesTSCache=%t)", span, updatesTSCache)
+		fn(span, updatesTSCache)
+	})
+}
+
 // actualSpan returns the actual request span which was operated on,
 // according to the existence of a resume span in the response. If
 // nothing was operated on, returns false.
@@ -353,15 +601,73 @@ func (ba *BatchRequest) Methods() []Method {
 	return res
 }
 
+// EstimatedSize returns the approximate size, in bytes, that ba would
+// occupy on the wire, computed as the sum of proto.Size over each
+// contained RequestUnion, the same per-request measure Split uses to bound
+// the encoded size of the parts it produces.
+func (ba BatchRequest) EstimatedSize() int64 {
+	var size int64
+	for i := range ba.Requests {
+		size += int64(proto.Size(&ba.Requests[i]))
+	}
+	return size
+}
+
+// SplitOptions bounds how BatchRequest.Split partitions a batch's requests,
+// in addition to the unconditional breaks required by flag incompatibility.
+type SplitOptions struct {
+	// CanSplitET indicates whether EndTransaction should be special-cased:
+	// if false, an EndTransaction request will never be split into a new
+	// chunk (otherwise, it is treated according to its flags). This allows
+	// sending a whole transaction in a single Batch when addressing a
+	// single range.
+	CanSplitET bool
+	// MaxRequestsPerPart bounds the number of requests placed in a single
+	// part. Zero means unbounded.
+	MaxRequestsPerPart int
+	// MaxBytesPerPart bounds the encoded size, in bytes, of the requests
+	// placed in a single part, as estimated by proto.Size. Zero means
+	// unbounded.
+	MaxBytesPerPart int64
+	// MaxSpansPerPart bounds the number of distinct key spans touched by
+	// the requests placed in a single part. Zero means unbounded.
+	MaxSpansPerPart int
+}
+
+// SplitInfo summarizes one part produced by BatchRequest.Split.
+type SplitInfo struct {
+	// Flags is the union of the flags the part was grouped by: each
+	// request's flags(), except that an isPrefix request grouped with a
+	// following request contributes that request's flags instead of its own.
+	Flags int
+	// NumBytes is the estimated encoded size, in bytes, of the part.
+	NumBytes int64
+	// NumSpans is the number of distinct key spans touched by the part.
+	NumSpans int
+}
+
 // Split separates the requests contained in a batch so that each subset of
 // requests can be executed by a Store (without changing order). In particular,
 // Admin requests are always singled out and mutating requests separated from
-// reads. The boolean parameter indicates whether EndTransaction should be
-// special-cased: If false, an EndTransaction request will never be split into
-// a new chunk (otherwise, it is treated according to its flags). This allows
-// sending a whole transaction in a single Batch when addressing a single
-// range.
-func (ba BatchRequest) Split(canSplitET bool) [][]RequestUnion {
+// reads, and opts.CanSplitET controls whether EndTransaction should be
+// special-cased: if false, an EndTransaction request will never be split
+// into a new chunk (otherwise, it is treated according to its flags). This
+// allows sending a whole transaction in a single Batch when addressing a
+// single range. In addition to flag compatibility, opts can bound each part
+// by request count, encoded byte size, and number of distinct key spans, so
+// that callers like DistSender can bound per-RPC memory and gRPC message
+// size deterministically for very large batches (imports, bulk Put
+// streams), rather than relying purely on flag-compatibility grouping,
+// which can otherwise produce an arbitrarily large single part. The
+// returned []SplitInfo gives the flags, byte size, and span count chosen
+// for each part, in the same order as the returned parts. Split first calls
+// NoStalenessConflict and returns its error, if any, since a
+// bounded-staleness batch combined with a write or admin request must never
+// reach the point of being grouped into RPC-sized parts.
+func (ba BatchRequest) Split(opts SplitOptions) ([][]RequestUnion, []SplitInfo, error) {
+	if err := ba.NoStalenessConflict(); err != nil {
+		return nil, nil, err
+	}
 	compatible := func(exFlags, newFlags int) bool {
 		// isAlone requests are never compatible.
 		if (exFlags&isAlone) != 0 || (newFlags&isAlone) != 0 {
@@ -383,12 +689,22 @@ func (ba BatchRequest) Split(canSplitET bool) [][]RequestUnion {
 		return (mask & exFlags) == (mask & newFlags)
 	}
 	var parts [][]RequestUnion
+	var infos []SplitInfo
 	for len(ba.Requests) > 0 {
 		part := ba.Requests
 		var gFlags, hFlags = -1, -1
+		var partBytes int64
+		partSpans := make(map[string]struct{})
+		// prefixRunStart is the index, within the tentative part, at which an
+		// as-yet-unresolved run of isPrefix requests began (-1 if the part
+		// doesn't currently end in one). isPrefix requests want to be grouped
+		// with the non-header request that follows them, so a budget-based
+		// break must never land inside such a run; see its use below.
+		prefixRunStart := -1
 		for i, union := range ba.Requests {
 			args := union.GetInner()
-			flags := args.flags()
+			rawFlags := args.flags()
+			flags := rawFlags
 			method := args.Method()
 			if (flags & isPrefix) != 0 {
 				// Requests with the isPrefix flag want to be grouped with the
@@ -401,7 +717,7 @@ func (ba BatchRequest) Split(canSplitET bool) [][]RequestUnion {
 						nArgs := nUnion.GetInner()
 						nFlags := nArgs.flags()
 						nMethod := nArgs.Method()
-						if !canSplitET && nMethod == EndTransaction {
+						if !opts.CanSplitET && nMethod == EndTransaction {
 							nFlags = 0 // always compatible
 						}
 						if (nFlags & isPrefix) == 0 {
@@ -417,9 +733,46 @@ func (ba BatchRequest) Split(canSplitET bool) [][]RequestUnion {
 				hFlags = -1 // reset
 			}
 			cmpFlags := flags
-			if !canSplitET && method == EndTransaction {
+			if !opts.CanSplitET && method == EndTransaction {
 				cmpFlags = 0 // always compatible
 			}
+
+			// Enforce the caller's size budgets once the part already
+			// contains at least one request, and before request i's flags,
+			// bytes, or spans are folded into gFlags/partBytes/partSpans
+			// below -- otherwise a request that budget-excludes itself from
+			// this part would still have polluted the SplitInfo reported for
+			// it. If the tentative part currently ends in an unresolved
+			// isPrefix run, the whole run is pushed into the next part
+			// together rather than being cut apart from the request it
+			// pairs with, unless that would leave the part empty, in which
+			// case the pairing is kept together here even though it
+			// overflows the budget -- the same way a single oversized
+			// request still forms a singleton part of its own.
+			if i > 0 {
+				h := args.Header()
+				spanKey := string(h.Key) + "\x00" + string(h.EndKey)
+				_, spanSeen := partSpans[spanKey]
+				newSpan := 0
+				if !spanSeen {
+					newSpan = 1
+				}
+				reqBytes := int64(proto.Size(&ba.Requests[i]))
+				overBudget := (opts.MaxRequestsPerPart > 0 && i >= opts.MaxRequestsPerPart) ||
+					(opts.MaxBytesPerPart > 0 && partBytes+reqBytes > opts.MaxBytesPerPart) ||
+					(opts.MaxSpansPerPart > 0 && len(partSpans)+newSpan > opts.MaxSpansPerPart)
+				if overBudget {
+					cut := i
+					if prefixRunStart != -1 {
+						cut = prefixRunStart
+					}
+					if cut > 0 {
+						part = ba.Requests[:cut]
+						break
+					}
+				}
+			}
+
 			if gFlags == -1 {
 				// If no flags are set so far, everything goes.
 				gFlags = flags
@@ -430,20 +783,38 @@ func (ba BatchRequest) Split(canSplitET bool) [][]RequestUnion {
 				}
 				gFlags |= flags
 			}
+
+			h := args.Header()
+			partBytes += int64(proto.Size(&ba.Requests[i]))
+			partSpans[string(h.Key)+"\x00"+string(h.EndKey)] = struct{}{}
+			if (rawFlags & isPrefix) != 0 {
+				if prefixRunStart == -1 {
+					prefixRunStart = i
+				}
+			} else {
+				prefixRunStart = -1
+			}
 		}
 		parts = append(parts, part)
+		infos = append(infos, SplitInfo{Flags: gFlags, NumBytes: partBytes, NumSpans: len(partSpans)})
 		ba.Requests = ba.Requests[len(part):]
 	}
-	return parts
+	return parts, infos, nil
 }
 
-// String gives a brief summary of the contained requests and keys in the batch.
-// TODO(tschottdorf): the key range is useful information, but requires `keys`.
-// See #2198.
+// String gives a brief summary of the contained requests and key range in
+// the batch, with the txn and key range taken from Summary() and the requests
+// listed by walking ba.Requests. The overall key range, previously
+// noted here as a TODO because it required importing `keys`, is now
+// computed by Summary() using only plain byte comparisons. See #2198.
 func (ba BatchRequest) String() string {
+	s := ba.Summary()
 	var str []string
-	if ba.Txn != nil {
-		str = append(str, fmt.Sprintf("[txn: %s]", ba.Txn.Short()))
+	if s.Txn != nil {
+		str = append(str, fmt.Sprintf("[txn: %s]", s.Txn.Short()))
+	}
+	if len(s.KeySpan.Key) > 0 {
+		str = append(str, fmt.Sprintf("[range: %s,%s)", s.KeySpan.Key, s.KeySpan.EndKey))
 	}
 	for count, arg := range ba.Requests {
 		// Limit the strings to provide just a summary. Without this limit
@@ -0,0 +1,331 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package roachpb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetActiveTimestampBoundedStaleness(t *testing.T) {
+	now := hlc.Timestamp{WallTime: 100}
+	nowFn := func() hlc.Timestamp { return now }
+	staleTS := hlc.Timestamp{WallTime: 90}
+	staleFn := func(minBound hlc.Timestamp, maxStaleness time.Duration) hlc.Timestamp {
+		return staleTS
+	}
+	bound := StalenessBound{MaxStalenessNanos: int64(10 * time.Second)}
+
+	t.Run("empty batch is not mistaken for a write", func(t *testing.T) {
+		ba := BatchRequest{}
+		ba.StalenessBound = bound
+		require.NoError(t, ba.SetActiveTimestamp(nowFn, staleFn))
+		require.Equal(t, staleTS, ba.Timestamp)
+	})
+
+	t.Run("read-only batch uses staleFn", func(t *testing.T) {
+		ba := BatchRequest{}
+		ba.StalenessBound = bound
+		ba.Add(&GetRequest{RequestHeader: RequestHeader{Key: Key("a")}})
+		require.NoError(t, ba.SetActiveTimestamp(nowFn, staleFn))
+		require.Equal(t, staleTS, ba.Timestamp)
+	})
+
+	t.Run("write batch is rejected", func(t *testing.T) {
+		ba := BatchRequest{}
+		ba.StalenessBound = bound
+		ba.Add(&PutRequest{RequestHeader: RequestHeader{Key: Key("a")}})
+		err := ba.SetActiveTimestamp(nowFn, staleFn)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "must not contain writes")
+	})
+
+	t.Run("EndTransaction is rejected", func(t *testing.T) {
+		ba := BatchRequest{}
+		ba.StalenessBound = bound
+		ba.Add(&GetRequest{RequestHeader: RequestHeader{Key: Key("a")}})
+		ba.Add(&EndTransactionRequest{})
+		err := ba.SetActiveTimestamp(nowFn, staleFn)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "must not contain an EndTransaction")
+	})
+
+	t.Run("transactional batch cannot set a staleness bound", func(t *testing.T) {
+		ba := BatchRequest{}
+		ba.StalenessBound = bound
+		ba.Txn = &Transaction{}
+		err := ba.SetActiveTimestamp(nowFn, staleFn)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "must not set a staleness bound")
+	})
+}
+
+func TestNoStalenessConflict(t *testing.T) {
+	bound := StalenessBound{MaxStalenessNanos: int64(time.Second)}
+
+	ba := BatchRequest{}
+	ba.StalenessBound = bound
+	ba.Add(&GetRequest{RequestHeader: RequestHeader{Key: Key("a")}})
+	require.NoError(t, ba.NoStalenessConflict())
+
+	ba.Add(&PutRequest{RequestHeader: RequestHeader{Key: Key("b")}})
+	require.Error(t, ba.NoStalenessConflict())
+}
+
+func TestSplitBudgets(t *testing.T) {
+	t.Run("MaxRequestsPerPart caps part size", func(t *testing.T) {
+		var ba BatchRequest
+		for i := 0; i < 5; i++ {
+			ba.Add(&GetRequest{RequestHeader: RequestHeader{Key: Key("a")}})
+		}
+		parts, infos, err := ba.Split(SplitOptions{MaxRequestsPerPart: 2})
+		require.NoError(t, err)
+		require.Len(t, parts, 3)
+		require.Len(t, infos, 3)
+		require.Len(t, parts[0], 2)
+		require.Len(t, parts[1], 2)
+		require.Len(t, parts[2], 1)
+	})
+
+	t.Run("budget break does not pollute SplitInfo.Flags with the excluded request's flags", func(t *testing.T) {
+		var ba BatchRequest
+		ba.Add(&GetRequest{RequestHeader: RequestHeader{Key: Key("a")}})
+		ba.Add(&GetRequest{RequestHeader: RequestHeader{Key: Key("b")}})
+		ba.Add(&ScanRequest{RequestHeader: RequestHeader{Key: Key("c"), EndKey: Key("d")}})
+		parts, infos, err := ba.Split(SplitOptions{MaxRequestsPerPart: 2})
+		require.NoError(t, err)
+		require.Len(t, parts, 2)
+		require.Len(t, parts[0], 2)
+		require.Zero(t, infos[0].Flags&isRange, "first part must not report isRange contributed by the excluded Scan")
+		require.NotZero(t, infos[1].Flags&isRange)
+	})
+
+	t.Run("MaxBytesPerPart never splits an isPrefix request from its paired write", func(t *testing.T) {
+		var ba BatchRequest
+		for i := 0; i < 3; i++ {
+			ba.Add(&QueryIntentRequest{RequestHeader: RequestHeader{Key: Key("k")}})
+			ba.Add(&PutRequest{RequestHeader: RequestHeader{Key: Key("k")}})
+		}
+		// A tiny byte budget would, without special-casing isPrefix pairs,
+		// land squarely between a QueryIntentRequest and the Put it guards.
+		parts, _, err := ba.Split(SplitOptions{MaxBytesPerPart: 1})
+		require.NoError(t, err)
+		for _, part := range parts {
+			for i, ru := range part {
+				if _, ok := ru.GetInner().(*QueryIntentRequest); ok {
+					require.Lessf(t, i+1, len(part), "QueryIntentRequest split from its paired write")
+					_, ok := part[i+1].GetInner().(*PutRequest)
+					require.True(t, ok, "QueryIntentRequest must be followed by its paired Put in the same part")
+				}
+			}
+		}
+	})
+
+	t.Run("MaxSpansPerPart bounds distinct key spans per part", func(t *testing.T) {
+		var ba BatchRequest
+		ba.Add(&GetRequest{RequestHeader: RequestHeader{Key: Key("a")}})
+		ba.Add(&GetRequest{RequestHeader: RequestHeader{Key: Key("a")}}) // same span, doesn't count twice
+		ba.Add(&GetRequest{RequestHeader: RequestHeader{Key: Key("b")}})
+		ba.Add(&GetRequest{RequestHeader: RequestHeader{Key: Key("c")}})
+		parts, infos, err := ba.Split(SplitOptions{MaxSpansPerPart: 2})
+		require.NoError(t, err)
+		require.Len(t, parts, 2)
+		require.LessOrEqual(t, infos[0].NumSpans, 2)
+	})
+}
+
+func TestExtendKeySpan(t *testing.T) {
+	t.Run("empty other leaves span untouched", func(t *testing.T) {
+		span := Span{Key: Key("b"), EndKey: Key("c")}
+		extendKeySpan(&span, Span{})
+		require.Equal(t, Span{Key: Key("b"), EndKey: Key("c")}, span)
+	})
+
+	t.Run("point key extends both ends of an empty span", func(t *testing.T) {
+		var span Span
+		extendKeySpan(&span, Span{Key: Key("m")})
+		require.Equal(t, Span{Key: Key("m"), EndKey: Key("m")}, span)
+	})
+
+	t.Run("grows to cover a span entirely to its left", func(t *testing.T) {
+		span := Span{Key: Key("m"), EndKey: Key("n")}
+		extendKeySpan(&span, Span{Key: Key("a"), EndKey: Key("b")})
+		require.Equal(t, Span{Key: Key("a"), EndKey: Key("n")}, span)
+	})
+
+	t.Run("grows to cover a span entirely to its right", func(t *testing.T) {
+		span := Span{Key: Key("m"), EndKey: Key("n")}
+		extendKeySpan(&span, Span{Key: Key("y"), EndKey: Key("z")})
+		require.Equal(t, Span{Key: Key("m"), EndKey: Key("z")}, span)
+	})
+
+	t.Run("overlapping span only extends the side it exceeds", func(t *testing.T) {
+		span := Span{Key: Key("m"), EndKey: Key("p")}
+		extendKeySpan(&span, Span{Key: Key("n"), EndKey: Key("z")})
+		require.Equal(t, Span{Key: Key("m"), EndKey: Key("z")}, span)
+	})
+
+	t.Run("span fully contained changes nothing", func(t *testing.T) {
+		span := Span{Key: Key("a"), EndKey: Key("z")}
+		extendKeySpan(&span, Span{Key: Key("m"), EndKey: Key("n")})
+		require.Equal(t, Span{Key: Key("a"), EndKey: Key("z")}, span)
+	})
+}
+
+func TestBatchRequestSummary(t *testing.T) {
+	var ba BatchRequest
+	ba.Txn = &Transaction{}
+	ba.Add(&GetRequest{RequestHeader: RequestHeader{Key: Key("a")}})
+	ba.Add(&PutRequest{RequestHeader: RequestHeader{Key: Key("c")}})
+	ba.Add(&EndTransactionRequest{Commit: true})
+
+	s := ba.Summary()
+	require.NotNil(t, s.Txn)
+	require.Equal(t, 1, s.Methods[Get])
+	require.Equal(t, 1, s.Methods[Put])
+	require.Equal(t, 1, s.Methods[EndTransaction])
+	require.Equal(t, Key("a"), s.KeySpan.Key)
+	require.Equal(t, Key("c"), s.KeySpan.EndKey)
+	require.True(t, s.HasEndTxn)
+	require.True(t, s.Commit)
+	require.Equal(t, ba.EstimatedSize(), s.TotalBytes)
+}
+
+func TestBatchResponseSummary(t *testing.T) {
+	var br BatchResponse
+	br.Txn = &Transaction{}
+	br.Add(&GetResponse{})
+	br.Add(&EndTransactionResponse{})
+
+	s := br.Summary()
+	require.NotNil(t, s.Txn)
+	require.True(t, s.HasEndTxn)
+	require.False(t, s.Commit, "Commit is not populated from a BatchResponse")
+}
+
+func TestBatchRequestStringRendersFromSummary(t *testing.T) {
+	var ba BatchRequest
+	ba.Add(&GetRequest{RequestHeader: RequestHeader{Key: Key("a")}})
+	ba.Add(&EndTransactionRequest{Commit: true})
+
+	str := ba.String()
+	require.Contains(t, str, "[range:")
+	require.Contains(t, str, "commit:true")
+}
+
+func TestBatchResponseStringRendersFromSummary(t *testing.T) {
+	var br BatchResponse
+	br.Add(&GetResponse{ResponseHeader: ResponseHeader{ResumeSpan: &Span{Key: Key("a"), EndKey: Key("b")}}})
+
+	str := br.String()
+	require.Contains(t, str, `[range: "a","b")`)
+	require.Contains(t, str, "GetResponse")
+}
+
+func TestTraceOpName(t *testing.T) {
+	testCases := []struct {
+		name string
+		ba   BatchRequest
+		want string
+	}{
+		{
+			name: "empty batch",
+			ba:   BatchRequest{},
+			want: "batch",
+		},
+		{
+			name: "admin batch",
+			ba: func() BatchRequest {
+				var ba BatchRequest
+				ba.Add(&AdminSplitRequest{RequestHeader: RequestHeader{Key: Key("a")}})
+				return ba
+			}(),
+			want: "admin batch",
+		},
+		{
+			name: "read-only batch",
+			ba: func() BatchRequest {
+				var ba BatchRequest
+				ba.Add(&GetRequest{RequestHeader: RequestHeader{Key: Key("a")}})
+				return ba
+			}(),
+			want: "read-only batch",
+		},
+		{
+			name: "read-write batch",
+			ba: func() BatchRequest {
+				var ba BatchRequest
+				ba.Add(&PutRequest{RequestHeader: RequestHeader{Key: Key("a")}})
+				return ba
+			}(),
+			want: "read-write batch",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.want, tc.ba.traceOpName())
+		})
+	}
+}
+
+func TestTraceBatch(t *testing.T) {
+	var ba BatchRequest
+	ba.Add(&GetRequest{RequestHeader: RequestHeader{Key: Key("a"), EndKey: Key("b")}})
+	ba.Add(&PutRequest{RequestHeader: RequestHeader{Key: Key("c")}})
+
+	batchCtx, startReq, finishBatch := ba.TraceBatch(context.Background())
+	require.NotNil(t, batchCtx)
+
+	for i := range ba.Requests {
+		reqCtx, finishReq := startReq(i)
+		require.NotNil(t, reqCtx)
+		// finishReq must accept both a nil response (request never executed)
+		// and a real one (accounting for a ResumeSpan) without panicking.
+		if i == 0 {
+			finishReq(nil)
+		} else {
+			finishReq(&PutResponse{})
+		}
+	}
+	finishBatch()
+}
+
+func TestIntentSpanIterateWithTrace(t *testing.T) {
+	var ba BatchRequest
+	ba.Txn = &Transaction{}
+	ba.Add(&PutRequest{RequestHeader: RequestHeader{Key: Key("a")}})
+
+	var got []Span
+	ba.IntentSpanIterateWithTrace(context.Background(), nil, func(span Span) {
+		got = append(got, span)
+	})
+	require.Equal(t, []Span{{Key: Key("a")}}, got)
+}
+
+func TestRefreshSpanIterateWithTrace(t *testing.T) {
+	var ba BatchRequest
+	ba.Txn = &Transaction{}
+	ba.Add(&GetRequest{RequestHeader: RequestHeader{Key: Key("a")}})
+
+	var got []Span
+	ba.RefreshSpanIterateWithTrace(context.Background(), nil, func(span Span, updatesTSCache bool) {
+		got = append(got, span)
+	})
+	require.Equal(t, []Span{{Key: Key("a")}}, got)
+}